@@ -0,0 +1,189 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	// ATTACHMENTS and INLINE_IMAGES are per-message, read from a
+	// SendParam's Others map as a JSON array of SAttachment.
+	ATTACHMENTS   = "ATTACHMENTS"
+	INLINE_IMAGES = "INLINE_IMAGES"
+
+	// MAX_ATTACHMENT_BYTES and MAX_TOTAL_BYTES are account-wide config
+	// keys; zero/unset means "no limit".
+	MAX_ATTACHMENT_BYTES = "MAX_ATTACHMENT_BYTES"
+	MAX_TOTAL_BYTES      = "MAX_TOTAL_BYTES"
+)
+
+// ErrAttachmentTooLarge is returned by send() when an attachment, or the
+// sum of all attachments, exceeds the configured limits so BatchSend can
+// record an accurate per-recipient failure instead of a generic error.
+var ErrAttachmentTooLarge = errors.Error("attachment too large")
+
+// attachmentFetchTimeout bounds how long fetching a single URL attachment
+// may take; the URL is caller-supplied, so an unbounded http.Get could
+// hang a worker on a slow or hostile (SSRF-probing) host well past the
+// overall send() timeout.
+const attachmentFetchTimeout = 15 * time.Second
+
+var attachmentHTTPClient = &http.Client{Timeout: attachmentFetchTimeout}
+
+// SAttachment describes one file attachment or inline (CID) image. Either
+// Content (base64) or URL must be set; Content is decoded and URL is
+// fetched lazily when the message is actually being built.
+type SAttachment struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Content  string `json:"content"`
+	URL      string `json:"url"`
+	// CID is the id an INLINE_IMAGES entry is embedded under, so it can be
+	// referenced from the HTML body as cid:<CID>. Entries of ATTACHMENTS
+	// are always attached by Name; their CID is not used.
+	CID string `json:"cid"`
+}
+
+func parseAttachments(raw string) ([]SAttachment, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var atts []SAttachment
+	if err := json.Unmarshal([]byte(raw), &atts); err != nil {
+		return nil, errors.Wrap(err, "parse attachments")
+	}
+	return atts, nil
+}
+
+// fetch returns the attachment's bytes, decoding Content or downloading
+// URL, and enforces maxBytes against the result. URL fetches are bounded
+// by both ctx and attachmentFetchTimeout, whichever fires first.
+func (self *SAttachment) fetch(ctx context.Context, maxBytes int64) ([]byte, error) {
+	var data []byte
+	if self.Content != "" {
+		decoded, err := base64.StdEncoding.DecodeString(self.Content)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode attachment content")
+		}
+		data = decoded
+	} else if self.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, self.URL, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "build attachment url request")
+		}
+		resp, err := attachmentHTTPClient.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetch attachment url")
+		}
+		defer resp.Body.Close()
+		var limited io.Reader = resp.Body
+		if maxBytes > 0 {
+			// Read at most one byte past the limit, so an oversized body
+			// is reported as ErrAttachmentTooLarge below.
+			limited = io.LimitReader(resp.Body, maxBytes+1)
+		}
+		data, err = io.ReadAll(limited)
+		if err != nil {
+			return nil, errors.Wrap(err, "read attachment url")
+		}
+	} else {
+		return nil, errors.Error("attachment has neither content nor url")
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, errors.Wrap(ErrAttachmentTooLarge, self.Name)
+	}
+	return data, nil
+}
+
+// attachFiles downloads/decodes attachments and inline images and wires
+// them onto gmsg. maxEach/maxTotal are enforced as each attachment is
+// fetched - not just after - so a single oversized attachment can't
+// stream past maxTotal before the limit is checked.
+func attachFiles(ctx context.Context, gmsg *gomail.Message, attachments, inlineImages []SAttachment, maxEach, maxTotal int64) error {
+	var total int64
+	attach := func(a SAttachment, embed bool) error {
+		// Cap this fetch by whichever of maxEach/the remaining total
+		// budget is tighter - including when maxEach is unset - so a
+		// single attachment can't stream unbounded bytes into memory
+		// before the running total is ever checked.
+		capBytes := maxEach
+		if maxTotal > 0 {
+			remaining := maxTotal - total
+			if remaining <= 0 {
+				return errors.Wrap(ErrAttachmentTooLarge, "total attachment size")
+			}
+			if capBytes <= 0 || remaining < capBytes {
+				capBytes = remaining
+			}
+		}
+		data, err := a.fetch(ctx, capBytes)
+		if err != nil {
+			return err
+		}
+		total += int64(len(data))
+		settings := []gomail.FileSetting{
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := io.Copy(w, bytes.NewReader(data))
+				return err
+			}),
+		}
+		if a.MimeType != "" {
+			settings = append(settings, gomail.SetHeader(map[string][]string{
+				"Content-Type": {a.MimeType},
+			}))
+		}
+		if embed {
+			gmsg.Embed(a.CID, settings...)
+		} else {
+			gmsg.Attach(a.Name, settings...)
+		}
+		return nil
+	}
+
+	for _, a := range attachments {
+		if err := attach(a, false); err != nil {
+			return err
+		}
+	}
+	for _, a := range inlineImages {
+		if err := attach(a, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseByteLimit(raw string) int64 {
+	if raw == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"strings"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/notify-plugins/pkg/common"
+)
+
+const (
+	// SUBJECT_PREFIX and REPLY_TO are account-wide config keys.
+	SUBJECT_PREFIX = "SUBJECT_PREFIX"
+	REPLY_TO       = "REPLY_TO"
+
+	// CC, BCC, AUTO_PLAINTEXT and PLAINTEXT are read from a SendParam's
+	// Others map, i.e. they're per-message rather than per-account.
+	CC             = "CC"
+	BCC            = "BCC"
+	AUTO_PLAINTEXT = "AUTO_PLAINTEXT"
+	PLAINTEXT      = "PLAINTEXT"
+)
+
+// splitAddrList turns a comma-separated address list into a slice,
+// trimming whitespace and dropping empty entries.
+func splitAddrList(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// setBody fills in gmsg's body, preferring a multipart/alternative message
+// (plaintext primary, HTML alternative) whenever a plaintext version was
+// supplied or requested via AUTO_PLAINTEXT.
+func (self *SEmailSender) setBody(gmsg *gomail.Message, args *common.SendParam) {
+	plain := args.Others[PLAINTEXT]
+	if plain == "" && args.Others[AUTO_PLAINTEXT] == "true" {
+		plain = htmlToText(args.Message)
+	}
+	if plain == "" {
+		gmsg.SetBody("text/html", args.Message)
+		return
+	}
+	gmsg.SetBody("text/plain", plain)
+	gmsg.AddAlternative("text/html", args.Message)
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+)
+
+// DSN turns on delivery-status notification requests (RFC 3461) for a
+// send; it's an account-wide config key, same family as HOSTNAME etc.
+const DSN = "DSN"
+
+// errEnvelopeID lets sendWithDSN hand the client-generated envelope-id
+// back out alongside a send error, so callers can correlate a later,
+// asynchronous DSN bounce with this attempt.
+type errEnvelopeID struct {
+	envelopeID string
+	err        error
+}
+
+// Error embeds the envelope-id in the message itself so it survives into
+// whatever the caller turns this error into (e.g. common.FailedRecord),
+// not just the EnvelopeID() accessor.
+func (self *errEnvelopeID) Error() string {
+	return fmt.Sprintf("%s (envelope-id=%s)", self.err.Error(), self.envelopeID)
+}
+func (self *errEnvelopeID) Unwrap() error      { return self.err }
+func (self *errEnvelopeID) EnvelopeID() string { return self.envelopeID }
+
+func newEnvelopeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate envelope-id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sendWithDSN delivers msg over a fresh connection built from dialer's
+// settings. When the server advertises the DSN extension it requests
+// NOTIFY=SUCCESS,FAILURE for every recipient and an ENVID on the envelope
+// so a later bounce can be matched back to this send; otherwise both
+// parameters are left off. gomail has no RFC 3461 support, so this talks raw SMTP instead of
+// going through dialer.Dial()/gomail.Send(). startTLSPolicy is honored
+// the same way connect() honors it for the pooled path.
+func sendWithDSN(dialer *gomail.Dialer, startTLSPolicy string, msg *gomail.Message) (string, error) {
+	envelopeID, err := newEnvelopeID()
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", dialer.Host, dialer.Port), 10*time.Second)
+	if err != nil {
+		return envelopeID, errors.Wrap(err, "dial")
+	}
+	if dialer.SSL {
+		conn = tls.Client(conn, dialerTLSConfig(dialer))
+	}
+	client, err := smtp.NewClient(conn, dialer.Host)
+	if err != nil {
+		return envelopeID, errors.Wrap(err, "smtp handshake")
+	}
+	defer client.Close()
+
+	if !dialer.SSL && startTLSPolicy != StartTLSNone {
+		ok, _ := client.Extension("STARTTLS")
+		switch {
+		case ok:
+			if err := client.StartTLS(dialerTLSConfig(dialer)); err != nil {
+				return envelopeID, errors.Wrap(err, "starttls")
+			}
+		case startTLSPolicy == StartTLSRequired:
+			return envelopeID, ErrSTARTTLSRequired
+		}
+	}
+	// dialer.Auth is normally only populated lazily inside gomail's own
+	// Dial(), which this path bypasses entirely; build it here the same
+	// way gomail does, otherwise ordinary username/password relays never
+	// see an AUTH command and every DSN send is rejected.
+	auth := dialer.Auth
+	if auth == nil && dialer.Username != "" {
+		if ok, auths := client.Extension("AUTH"); ok {
+			if strings.Contains(auths, "CRAM-MD5") {
+				auth = smtp.CRAMMD5Auth(dialer.Username, dialer.Password)
+			} else {
+				auth = smtp.PlainAuth("", dialer.Username, dialer.Password, dialer.Host)
+			}
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(auth); err != nil {
+				return envelopeID, errors.Wrap(err, "auth")
+			}
+		}
+	}
+
+	from := headerAddr(msg, "From")
+	recipients := append(append([]string{}, msg.GetHeader("To")...), msg.GetHeader("Cc")...)
+	recipients = append(recipients, msg.GetHeader("Bcc")...)
+
+	dsnSupported, _ := client.Extension("DSN")
+	if err := sendCmd(client, fmt.Sprintf("MAIL FROM:<%s>%s", from, dsnParam(dsnSupported, " ENVID="+envelopeID)), 250); err != nil {
+		return envelopeID, errors.Wrap(err, "MAIL FROM")
+	}
+	for _, rcpt := range recipients {
+		if err := sendCmd(client, fmt.Sprintf("RCPT TO:<%s>%s", rcpt, dsnParam(dsnSupported, " NOTIFY=SUCCESS,FAILURE")), 250); err != nil {
+			return envelopeID, errors.Wrap(err, "RCPT TO")
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return envelopeID, errors.Wrap(err, "DATA")
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return envelopeID, errors.Wrap(err, "write message")
+	}
+	if err := w.Close(); err != nil {
+		return envelopeID, errors.Wrap(err, "close DATA")
+	}
+	return envelopeID, client.Quit()
+}
+
+// dialerTLSConfig mirrors gomail's own Dialer.tlsConfig(): it falls back
+// to a bare ServerName:dialer.Host config when TLSConfig was never set,
+// instead of handing tls.Client a nil config (empty ServerName, which
+// fails certificate verification against the real host).
+func dialerTLSConfig(dialer *gomail.Dialer) *tls.Config {
+	if dialer.TLSConfig != nil {
+		return dialer.TLSConfig
+	}
+	return &tls.Config{ServerName: dialer.Host}
+}
+
+func dsnParam(supported bool, param string) string {
+	if !supported {
+		return ""
+	}
+	return param
+}
+
+// sendCmd issues a raw ESMTP command carrying parameters net/smtp.Client
+// has no API for (ENVID/NOTIFY) and checks the response code.
+func sendCmd(client *smtp.Client, cmd string, expectCode int) error {
+	id, err := client.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(expectCode)
+	return err
+}
+
+func headerAddr(msg *gomail.Message, field string) string {
+	vals := msg.GetHeader(field)
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+)
+
+func newTestMessage() *gomail.Message {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", "sender@example.com")
+	msg.SetHeader("To", "rcpt@example.com")
+	return msg
+}
+
+func testDialer(host string) *gomail.Dialer {
+	return gomail.NewDialer(host, 587, "user", "pass")
+}
+
+func TestDsnParam(t *testing.T) {
+	if got := dsnParam(false, " ENVID=abc"); got != "" {
+		t.Errorf("dsnParam(false, ...) = %q, want empty", got)
+	}
+	if got := dsnParam(true, " ENVID=abc"); got != " ENVID=abc" {
+		t.Errorf("dsnParam(true, ...) = %q, want %q", got, " ENVID=abc")
+	}
+}
+
+func TestMailFromAndRcptToFormatting(t *testing.T) {
+	envelopeID := "deadbeef"
+
+	mailFrom := fmt.Sprintf("MAIL FROM:<%s>%s", "sender@example.com", dsnParam(true, " ENVID="+envelopeID))
+	if want := "MAIL FROM:<sender@example.com> ENVID=deadbeef"; mailFrom != want {
+		t.Errorf("MAIL FROM = %q, want %q", mailFrom, want)
+	}
+	if mailFromNoDSN := fmt.Sprintf("MAIL FROM:<%s>%s", "sender@example.com", dsnParam(false, " ENVID="+envelopeID)); mailFromNoDSN != "MAIL FROM:<sender@example.com>" {
+		t.Errorf("MAIL FROM (no DSN) = %q", mailFromNoDSN)
+	}
+
+	rcptTo := fmt.Sprintf("RCPT TO:<%s>%s", "rcpt@example.com", dsnParam(true, " NOTIFY=SUCCESS,FAILURE"))
+	if want := "RCPT TO:<rcpt@example.com> NOTIFY=SUCCESS,FAILURE"; rcptTo != want {
+		t.Errorf("RCPT TO = %q, want %q", rcptTo, want)
+	}
+}
+
+func TestHeaderAddr(t *testing.T) {
+	msg := newTestMessage()
+	if got := headerAddr(msg, "From"); got != "sender@example.com" {
+		t.Errorf("headerAddr(From) = %q, want %q", got, "sender@example.com")
+	}
+	if got := headerAddr(msg, "X-Missing"); got != "" {
+		t.Errorf("headerAddr(missing) = %q, want empty", got)
+	}
+}
+
+func TestNewEnvelopeID(t *testing.T) {
+	id, err := newEnvelopeID()
+	if err != nil {
+		t.Fatalf("newEnvelopeID: %v", err)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		t.Errorf("envelope-id %q is not valid hex: %v", id, err)
+	}
+	if len(id) != 32 {
+		t.Errorf("envelope-id length = %d, want 32", len(id))
+	}
+
+	id2, err := newEnvelopeID()
+	if err != nil {
+		t.Fatalf("newEnvelopeID: %v", err)
+	}
+	if id == id2 {
+		t.Error("two calls to newEnvelopeID produced the same id")
+	}
+}
+
+func TestErrEnvelopeIDError(t *testing.T) {
+	inner := errors.Error("535 Authentication failed")
+	wrapped := &errEnvelopeID{envelopeID: "deadbeef", err: inner}
+
+	if got := wrapped.EnvelopeID(); got != "deadbeef" {
+		t.Errorf("EnvelopeID() = %q, want %q", got, "deadbeef")
+	}
+	if msg := wrapped.Error(); !strings.Contains(msg, "deadbeef") {
+		t.Errorf("Error() = %q, want it to contain the envelope-id", msg)
+	}
+	if wrapped.Unwrap() != error(inner) {
+		t.Error("Unwrap() did not return the wrapped error")
+	}
+}
+
+func TestDialerTLSConfigFallback(t *testing.T) {
+	dialer := testDialer("smtp.example.com")
+	conf := dialerTLSConfig(dialer)
+	if conf == nil {
+		t.Fatal("dialerTLSConfig returned nil")
+	}
+	if conf.ServerName != "smtp.example.com" {
+		t.Errorf("ServerName = %q, want %q", conf.ServerName, "smtp.example.com")
+	}
+}
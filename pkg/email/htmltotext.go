@@ -0,0 +1,114 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockTags are unwrapped into their own paragraph so the plaintext
+// rendering keeps roughly the same visual structure as the HTML.
+var blockTags = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.Div:        true,
+	atom.Br:         true,
+	atom.Li:         true,
+	atom.Tr:         true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Blockquote: true,
+}
+
+// skippedTags' subtrees never contribute text to the plaintext rendering.
+var skippedTags = map[atom.Atom]bool{
+	atom.Script: true,
+	atom.Style:  true,
+	atom.Head:   true,
+}
+
+// htmlToText renders a best-effort plaintext alternative of an HTML email
+// body: block tags become paragraph breaks, links are expanded to
+// "text (url)", and <script>/<style> subtrees are dropped entirely.
+func htmlToText(htm string) string {
+	var buf strings.Builder
+	z := html.NewTokenizer(strings.NewReader(htm))
+	var href string
+	skipDepth := 0
+
+Loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break Loop
+		case html.TextToken:
+			if skipDepth == 0 {
+				buf.WriteString(string(z.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if skippedTags[tok.DataAtom] {
+				if tok.Type == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if tok.DataAtom == atom.A {
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" {
+						href = attr.Val
+					}
+				}
+			}
+			if blockTags[tok.DataAtom] {
+				buf.WriteString("\n")
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			if skippedTags[tok.DataAtom] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if tok.DataAtom == atom.A {
+				if href != "" {
+					buf.WriteString(" (" + href + ")")
+					href = ""
+				}
+			}
+			if blockTags[tok.DataAtom] {
+				buf.WriteString("\n")
+			}
+		}
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
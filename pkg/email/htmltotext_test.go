@@ -0,0 +1,70 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import "testing"
+
+func TestHtmlToText(t *testing.T) {
+	cases := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "empty",
+			html: "",
+			want: "",
+		},
+		{
+			name: "single paragraph",
+			html: "<p>Hello world</p>",
+			want: "Hello world",
+		},
+		{
+			name: "multiple block tags become separate lines",
+			html: "<p>Line1</p><p>Line2</p>",
+			want: "Line1\nLine2",
+		},
+		{
+			name: "br splits a single block into two lines",
+			html: "<p>Line1<br>Line2</p>",
+			want: "Line1\nLine2",
+		},
+		{
+			name: "link is expanded to text (url)",
+			html: `<a href="http://example.com">Click here</a>`,
+			want: "Click here (http://example.com)",
+		},
+		{
+			name: "script and style subtrees are dropped",
+			html: "<p>before</p><script>alert(1)</script><style>p{color:red}</style><p>after</p>",
+			want: "before\nafter",
+		},
+		{
+			name: "blank lines from empty block tags are collapsed",
+			html: "<div></div><p>Text</p><div>   </div>",
+			want: "Text",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := htmlToText(c.html)
+			if got != c.want {
+				t.Errorf("htmlToText(%q) = %q, want %q", c.html, got, c.want)
+			}
+		})
+	}
+}
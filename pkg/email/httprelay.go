@@ -0,0 +1,146 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/notify-plugins/pkg/common"
+)
+
+// Per-channel config keys for the "http" transport, which POSTs the
+// built message to a relay such as Mailgun/SES instead of dialing SMTP.
+const (
+	RELAY_URL   = "RELAY_URL"
+	RELAY_TOKEN = "RELAY_TOKEN"
+	// RELAY_FORMAT is "json" (default) or "rfc822".
+	RELAY_FORMAT = "RELAY_FORMAT"
+)
+
+const relayFormatRFC822 = "rfc822"
+
+type sHTTPTransport struct {
+	url    string
+	token  string
+	format string
+	client *http.Client
+}
+
+func newHTTPTransport(configCache *common.SConfigCache) (Transport, error) {
+	url, _ := configCache.Get(RELAY_URL)
+	if url == "" {
+		return nil, errors.Wrap(common.ErrConfigMiss, RELAY_URL)
+	}
+	token, _ := configCache.Get(RELAY_TOKEN)
+	format, _ := configCache.Get(RELAY_FORMAT)
+	return &sHTTPTransport{
+		url:    url,
+		token:  token,
+		format: format,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+type sRelayMessage struct {
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Raw     string   `json:"raw"`
+}
+
+func (self *sHTTPTransport) Send(ctx context.Context, msg *gomail.Message) error {
+	var body []byte
+	var contentType string
+
+	var raw bytes.Buffer
+	if _, err := msg.WriteTo(&raw); err != nil {
+		return errors.Wrap(err, "render message")
+	}
+
+	if self.format == relayFormatRFC822 {
+		body = raw.Bytes()
+		contentType = "message/rfc822"
+	} else {
+		// To carries every envelope recipient, not just the "To" header,
+		// since relays that route delivery off the JSON field (rather
+		// than parsing Raw) would otherwise silently drop Cc/Bcc.
+		to := append(append([]string{}, msg.GetHeader("To")...), msg.GetHeader("Cc")...)
+		to = append(to, msg.GetHeader("Bcc")...)
+		payload := sRelayMessage{
+			From:    headerAddr(msg, "From"),
+			To:      to,
+			Subject: headerAddr(msg, "Subject"),
+			Raw:     base64.StdEncoding.EncodeToString(raw.Bytes()),
+		}
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return errors.Wrap(err, "marshal relay payload")
+		}
+		body = encoded
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, self.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "build relay request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	if self.token != "" {
+		req.Header.Set("Authorization", "Bearer "+self.token)
+	}
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "relay request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.Error(fmt.Sprintf("relay returned %d: %s", resp.StatusCode, string(respBody)))
+	}
+	return nil
+}
+
+// Validate probes the relay URL with a HEAD request; most relay APIs
+// reject HEAD with a 4xx/5xx rather than refusing the connection, so any
+// response (not just a 2xx) is treated as "reachable".
+func (self *sHTTPTransport) Validate(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, self.url, nil)
+	if err != nil {
+		return errors.Wrap(err, "build relay probe request")
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "relay unreachable")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (self *sHTTPTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"net/smtp"
+	"testing"
+)
+
+func TestXOAuth2AuthStart(t *testing.T) {
+	auth := &xoauth2Auth{username: "user@example.com", token: "tok123"}
+
+	mech, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if mech != "XOAUTH2" {
+		t.Errorf("mechanism = %q, want XOAUTH2", mech)
+	}
+	want := "user=user@example.com\x01auth=Bearer tok123\x01\x01"
+	if string(resp) != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+}
+
+func TestXOAuth2AuthStartRequiresTLS(t *testing.T) {
+	auth := &xoauth2Auth{username: "user@example.com", token: "tok123"}
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: false}); err == nil {
+		t.Error("expected error sending a bearer token over a cleartext session")
+	}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "localhost", TLS: false}); err != nil {
+		t.Errorf("expected localhost to be allowed without TLS, got %v", err)
+	}
+}
+
+func TestXOAuth2AuthNext(t *testing.T) {
+	auth := &xoauth2Auth{username: "user@example.com", token: "tok123"}
+
+	resp, err := auth.Next([]byte(`{"status":"401"}`), true)
+	if err != nil {
+		t.Fatalf("Next(more=true): %v", err)
+	}
+	if len(resp) != 0 {
+		t.Errorf("Next(more=true) response = %q, want empty", resp)
+	}
+
+	resp, err = auth.Next(nil, false)
+	if err != nil {
+		t.Fatalf("Next(more=false): %v", err)
+	}
+	if resp != nil {
+		t.Errorf("Next(more=false) response = %q, want nil", resp)
+	}
+}
+
+func TestOAuthBearerAuthStart(t *testing.T) {
+	auth := &oauthBearerAuth{username: "user@example.com", token: "tok123"}
+
+	mech, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if mech != "OAUTHBEARER" {
+		t.Errorf("mechanism = %q, want OAUTHBEARER", mech)
+	}
+	want := "n,a=user@example.com,\x01auth=Bearer tok123\x01\x01"
+	if string(resp) != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+}
+
+func TestOAuthBearerAuthStartRequiresTLS(t *testing.T) {
+	auth := &oauthBearerAuth{username: "user@example.com", token: "tok123"}
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: false}); err == nil {
+		t.Error("expected error sending a bearer token over a cleartext session")
+	}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "127.0.0.1", TLS: false}); err != nil {
+		t.Errorf("expected 127.0.0.1 to be allowed without TLS, got %v", err)
+	}
+}
+
+func TestIsLocalhost(t *testing.T) {
+	cases := map[string]bool{
+		"localhost":      true,
+		"127.0.0.1":      true,
+		"::1":            true,
+		"smtp.gmail.com": false,
+		"":               false,
+	}
+	for name, want := range cases {
+		if got := isLocalhost(name); got != want {
+			t.Errorf("isLocalhost(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -16,10 +16,12 @@ package email
 
 import (
 	"context"
-	"crypto/tls"
+	stderrors "errors"
 	"fmt"
+	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/gomail.v2"
@@ -30,12 +32,25 @@ import (
 	"yunion.io/x/notify-plugins/pkg/common"
 )
 
+// maxSendAttempts bounds how many times a state machine will redial and
+// resend a message after a transient SMTP 4xx / network error before
+// giving up and reporting the last error back to the caller.
+const maxSendAttempts = 3
+
 type SConnectInfo struct {
 	Hostname string
 	Hostport int
 	Username string
 	Password string
 	Ssl      bool
+
+	// AuthMethod is one of AuthMethodPlain (default), AuthMethodXOAuth2 or
+	// AuthMethodOAuthBearer. When it names an OAuth2 mechanism, OAuth2 must
+	// be populated and Password is ignored.
+	AuthMethod string
+	OAuth2     *OAuth2Config
+
+	TLS STLSConfig
 }
 
 type SEmailSender struct {
@@ -45,10 +60,39 @@ type SEmailSender struct {
 	chanelSize int
 
 	configCache *common.SConfigCache
+
+	// authMethod/oauth2/authUsername are populated by initSender whenever
+	// AUTH_METHOD names an OAuth2 mechanism; sSender.Run refreshes the
+	// dialer's Auth from these right before every dial.
+	authMethod   string
+	oauth2       *OAuth2Config
+	authUsername string
+
+	// dsn mirrors the DSN config key; wg tracks the sender goroutines so
+	// restartSender can wait for them to fully exit before initSender
+	// re-creates self.senders, instead of racing with them.
+	dsn bool
+	// startTLSPolicy mirrors STARTTLS_POLICY for the plain (non-SSL)
+	// case; sSender.connect() checks it to bypass gomail's opportunistic
+	// STARTTLS when it's StartTLSNone.
+	startTLSPolicy string
+	wg             sync.WaitGroup
+	deadLetter     func(msg *gomail.Message, err error)
+
+	// transport is non-nil when TRANSPORT names a backend other than
+	// "smtp"; send() then hands the built message straight to it instead
+	// of going through msgChan/self.senders.
+	transport Transport
+}
+
+// SetDeadLetterFunc registers a callback invoked whenever a message is
+// given up on after a permanent (5xx) SMTP failure.
+func (self *SEmailSender) SetDeadLetterFunc(f func(msg *gomail.Message, err error)) {
+	self.deadLetter = f
 }
 
 func (self *SEmailSender) IsReady(ctx context.Context) bool {
-	return self.msgChan != nil
+	return self.msgChan != nil || self.transport != nil
 }
 
 func (self *SEmailSender) UpdateConfig(ctx context.Context, configs map[string]string) error {
@@ -58,6 +102,26 @@ func (self *SEmailSender) UpdateConfig(ctx context.Context, configs map[string]s
 }
 
 func ValidateConfig(ctx context.Context, configs map[string]string) (isValid bool, msg string, err error) {
+	switch configs[TRANSPORT] {
+	case TransportSendmail, TransportHTTP:
+		// sendmail/http don't use HOSTNAME/USERNAME/PASSWORD at all; just
+		// make sure the backend itself is actually usable.
+		cache := common.NewConfigCache()
+		cache.BatchSet(configs)
+		transport, terr := newTransport(configs[TRANSPORT], cache)
+		if terr != nil {
+			msg = terr.Error()
+			return
+		}
+		defer transport.Close()
+		if terr := transport.Validate(ctx); terr != nil {
+			msg = terr.Error()
+			return
+		}
+		isValid = true
+		return
+	}
+
 	vals, ok, noKey := common.CheckMap(configs, HOSTNAME, HOSTPORT, USERNAME, PASSWORD)
 	if !ok {
 		err = fmt.Errorf("require %s", noKey)
@@ -81,6 +145,37 @@ func ValidateConfig(ctx context.Context, configs map[string]string) (isValid boo
 	} else if ssl, _ := configs[SSL]; ssl == "true" {
 		conn.Ssl = true
 	}
+
+	conn.TLS = STLSConfig{
+		Insecure:       configs[TLS_INSECURE] == "true",
+		ServerName:     configs[TLS_SERVER_NAME],
+		CACert:         configs[TLS_CA_CERT],
+		ClientCert:     configs[TLS_CLIENT_CERT],
+		ClientKey:      configs[TLS_CLIENT_KEY],
+		StartTLSPolicy: configs[STARTTLS_POLICY],
+	}
+
+	conn.AuthMethod, _ = configs[AUTH_METHOD]
+	switch conn.AuthMethod {
+	case AuthMethodXOAuth2, AuthMethodOAuthBearer:
+		conn.OAuth2 = &OAuth2Config{
+			Token:        configs[OAUTH2_TOKEN],
+			TokenURL:     configs[OAUTH2_TOKEN_URL],
+			ClientID:     configs[OAUTH2_CLIENT_ID],
+			ClientSecret: configs[OAUTH2_CLIENT_SECRET],
+			RefreshToken: configs[OAUTH2_REFRESH_TOKEN],
+		}
+		// OAuth2 validation only exercises the token endpoint / refresh
+		// cycle; it never attempts a plain SMTP login with the result.
+		if _, err = conn.OAuth2.fetchToken(ctx); err != nil {
+			msg = fmt.Sprintf("fetch oauth2 token failed: %s", err.Error())
+			err = nil
+			return
+		}
+		isValid = true
+		return
+	}
+
 	err = validateConfig(conn)
 	if err == nil {
 		isValid = true
@@ -94,6 +189,12 @@ func ValidateConfig(ctx context.Context, configs map[string]string) (isValid boo
 		msg = "Connect timeout"
 	case strings.Contains(err.Error(), "no such host"):
 		msg = "No such host"
+	case errors.Cause(err) == ErrSTARTTLSRequired:
+		msg = "STARTTLS required but unsupported"
+	case errors.Cause(err) == ErrTLSHostMismatch || strings.Contains(err.Error(), "certificate is valid for"):
+		msg = "hostname mismatch"
+	case errors.Cause(err) == ErrTLSCertVerify || strings.Contains(err.Error(), "certificate signed by unknown authority") || strings.Contains(err.Error(), "x509:"):
+		msg = "cert verification failed"
 	default:
 		msg = err.Error()
 	}
@@ -107,7 +208,7 @@ func (self *SEmailSender) FetchContact(ctx context.Context, related string) (str
 
 func (self *SEmailSender) Send(ctx context.Context, params *common.SendParam) error {
 	log.Debugf("reviced msg for %s: %s", params.Contact, params.Message)
-	return self.send(params)
+	return self.send(ctx, params)
 }
 
 func (self *SEmailSender) BatchSend(ctx context.Context, params *common.BatchSendParam) ([]*common.FailedRecord, error) {
@@ -124,7 +225,7 @@ func NewSender(config common.IServiceOptions) common.ISender {
 	}
 }
 
-func (self *SEmailSender) send(args *common.SendParam) error {
+func (self *SEmailSender) send(ctx context.Context, args *common.SendParam) error {
 	gmsg := gomail.NewMessage()
 	sendAddress, _ := self.configCache.Get(SENDERADDRESS)
 	if sendAddress == "" {
@@ -132,28 +233,68 @@ func (self *SEmailSender) send(args *common.SendParam) error {
 	}
 	gmsg.SetHeader("From", sendAddress)
 	gmsg.SetHeader("To", args.Contact)
-	gmsg.SetHeader("Subject", args.Topic)
-	gmsg.SetHeader("Subject", args.Title)
-	gmsg.SetBody("text/html", args.Message)
-	ret := make(chan bool, 1)
-	self.msgChan <- &sSendUnit{gmsg, ret}
+
+	subject := args.Topic
+	if subject == "" {
+		subject = args.Title
+	}
+	if prefix, _ := self.configCache.Get(SUBJECT_PREFIX); prefix != "" {
+		subject = prefix + subject
+	}
+	gmsg.SetHeader("Subject", subject)
+
+	if cc := splitAddrList(args.Others[CC]); len(cc) > 0 {
+		gmsg.SetHeader("Cc", cc...)
+	}
+	if bcc := splitAddrList(args.Others[BCC]); len(bcc) > 0 {
+		gmsg.SetHeader("Bcc", bcc...)
+	}
+	if replyTo, _ := self.configCache.Get(REPLY_TO); replyTo != "" {
+		gmsg.SetHeader("Reply-To", replyTo)
+	}
+
+	self.setBody(gmsg, args)
+
+	attachments, err := parseAttachments(args.Others[ATTACHMENTS])
+	if err != nil {
+		return err
+	}
+	inlineImages, err := parseAttachments(args.Others[INLINE_IMAGES])
+	if err != nil {
+		return err
+	}
+	if len(attachments) > 0 || len(inlineImages) > 0 {
+		maxEach, _ := self.configCache.Get(MAX_ATTACHMENT_BYTES)
+		maxTotal, _ := self.configCache.Get(MAX_TOTAL_BYTES)
+		if err := attachFiles(ctx, gmsg, attachments, inlineImages, parseByteLimit(maxEach), parseByteLimit(maxTotal)); err != nil {
+			return err
+		}
+	}
+
+	if self.transport != nil {
+		return self.transport.Send(ctx, gmsg)
+	}
+
+	ret := make(chan error, 1)
+	self.msgChan <- &sSendUnit{message: gmsg, result: ret}
 	timer := time.NewTimer(1 * time.Minute)
 	defer timer.Stop()
 	select {
-	case suc := <-ret:
-		if !suc {
-			return errors.Error("send error")
-		}
+	case err := <-ret:
+		return err
 	case <-timer.C:
 		return errors.Error("send error, time out")
 	}
-	return nil
 }
 
 func (self *SEmailSender) restartSender() error {
 	for _, sender := range self.senders {
 		sender.stop()
 	}
+	// Wait for every Run() goroutine to actually return before initSender
+	// below re-creates self.senders, otherwise the old goroutines keep
+	// reading self.dialer/self.sender out from under the new ones.
+	self.wg.Wait()
 	return self.initSender()
 }
 
@@ -161,16 +302,27 @@ func validateConfig(connInfo SConnectInfo) error {
 	errChan := make(chan error, 1)
 	go func() {
 		dialer := gomail.NewDialer(connInfo.Hostname, connInfo.Hostport, connInfo.Username, connInfo.Password)
-		if connInfo.Ssl {
-			dialer.SSL = true
-		} else {
-			dialer.SSL = false
-			// StartLSConfig
-			dialer.TLSConfig = &tls.Config{
-				InsecureSkipVerify: true,
+		dialer.SSL = connInfo.Ssl
+		if !connInfo.Ssl && connInfo.TLS.StartTLSPolicy == StartTLSRequired {
+			if err := probeStartTLS(connInfo.Hostname, connInfo.Hostport); err != nil {
+				errChan <- err
+				return
 			}
 		}
-		sender, err := dialer.Dial()
+		// TLS_*/STARTTLS_POLICY apply whether the connection starts TLS
+		// (implicit, Ssl=true) or upgrades to it (STARTTLS).
+		tlsConf, err := buildTLSConfig(connInfo.Hostname, connInfo.TLS)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		dialer.TLSConfig = tlsConf
+		var sender gomail.SendCloser
+		if connInfo.TLS.StartTLSPolicy == StartTLSNone {
+			sender, err = dialNoStartTLS(dialer)
+		} else {
+			sender, err = dialer.Dial()
+		}
 		if err != nil {
 			errChan <- err
 			return
@@ -189,31 +341,102 @@ func validateConfig(connInfo SConnectInfo) error {
 }
 
 func (self *SEmailSender) initSender() error {
+	transportKind, _ := self.configCache.Get(TRANSPORT)
+	transport, err := newTransport(transportKind, self.configCache)
+	if err != nil {
+		return err
+	}
+	if self.transport != nil {
+		self.transport.Close()
+	}
+	self.transport = transport
+	if self.transport != nil {
+		// sendmail/http don't keep a persistent connection pool, so the
+		// SMTP dialer/worker-pool setup below doesn't apply to them.
+		return nil
+	}
+
 	vals, ok, noKey := self.configCache.BatchGet(HOSTNAME, PASSWORD, USERNAME, HOSTPORT)
 	if !ok {
 		return errors.Wrap(common.ErrConfigMiss, noKey)
 	}
 	hostName, password, userName, hostPortStr := vals[0], vals[1], vals[2], vals[3]
 	hostPort, _ := strconv.Atoi(hostPortStr)
-	dialer := gomail.NewDialer(hostName, hostPort, userName, password)
+
+	authMethod, _ := self.configCache.Get(AUTH_METHOD)
+	if authMethod == AuthMethodXOAuth2 || authMethod == AuthMethodOAuthBearer {
+		token, _ := self.configCache.Get(OAUTH2_TOKEN)
+		tokenURL, _ := self.configCache.Get(OAUTH2_TOKEN_URL)
+		clientID, _ := self.configCache.Get(OAUTH2_CLIENT_ID)
+		clientSecret, _ := self.configCache.Get(OAUTH2_CLIENT_SECRET)
+		refreshToken, _ := self.configCache.Get(OAUTH2_REFRESH_TOKEN)
+		self.oauth2 = &OAuth2Config{
+			Token:        token,
+			TokenURL:     tokenURL,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RefreshToken: refreshToken,
+		}
+		self.authMethod = authMethod
+		self.authUsername = userName
+	} else {
+		self.oauth2 = nil
+		self.authMethod = ""
+	}
+
+	tlsInsecure, _ := self.configCache.Get(TLS_INSECURE)
+	serverName, _ := self.configCache.Get(TLS_SERVER_NAME)
+	caCert, _ := self.configCache.Get(TLS_CA_CERT)
+	clientCert, _ := self.configCache.Get(TLS_CLIENT_CERT)
+	clientKey, _ := self.configCache.Get(TLS_CLIENT_KEY)
+	startTLSPolicy, _ := self.configCache.Get(STARTTLS_POLICY)
+
 	sslg, _ := self.configCache.Get(GLOBALSSL)
 	ssl, _ := self.configCache.Get(SSL)
-	if sslg == "true" || ssl == "true" {
-		dialer.SSL = true
+	useSSL := sslg == "true" || ssl == "true"
+	if useSSL {
+		self.startTLSPolicy = ""
 		log.Infof("enable ssl")
 	} else {
-		dialer.SSL = false
-		// StartTLS process in dialer.Dial() will use TLSConfig
-		dialer.TLSConfig = &tls.Config{
-			InsecureSkipVerify: true,
+		self.startTLSPolicy = startTLSPolicy
+		if startTLSPolicy == StartTLSRequired {
+			if err := probeStartTLS(hostName, hostPort); err != nil {
+				return errors.Wrap(err, "probe STARTTLS")
+			}
 		}
 		log.Infof("disable ssl")
 	}
+	// TLS_*/STARTTLS_POLICY apply whether the connection starts TLS
+	// (implicit, SSL=true) or upgrades to it (STARTTLS), so the same
+	// tls.Config is built and assigned in both cases.
+	tlsConf, err := buildTLSConfig(hostName, STLSConfig{
+		Insecure:       tlsInsecure == "true",
+		ServerName:     serverName,
+		CACert:         caCert,
+		ClientCert:     clientCert,
+		ClientKey:      clientKey,
+		StartTLSPolicy: startTLSPolicy,
+	})
+	if err != nil {
+		return errors.Wrap(err, "build TLS config")
+	}
+
+	dsn, _ := self.configCache.Get(DSN)
+	self.dsn = dsn == "true"
+
 	// Configs are obtained successfully, it's time to init msgChan.
 	if self.msgChan == nil {
 		self.msgChan = make(chan *sSendUnit, self.chanelSize)
 	}
 	for i := 0; i < self.senderNum; i++ {
+		// Each sSender gets its own *gomail.Dialer: connect()/
+		// refreshOAuth2Auth() assign self.dialer.Auth on every dial, and
+		// a dialer shared across senderNum goroutines would race on that
+		// field. tlsConf is never mutated after this point, so sharing
+		// that pointer across dialers is safe.
+		dialer := gomail.NewDialer(hostName, hostPort, userName, password)
+		dialer.SSL = useSSL
+		dialer.TLSConfig = tlsConf
 		sender := sSender{
 			number: i + 1,
 			dialer: dialer,
@@ -223,6 +446,7 @@ func (self *SEmailSender) initSender() error {
 			man:    self,
 		}
 		self.senders[i] = sender
+		self.wg.Add(1)
 		go sender.Run()
 	}
 
@@ -242,7 +466,7 @@ type sSender struct {
 }
 
 func (self *sSender) Run() {
-	var err error
+	defer self.man.wg.Done()
 Loop:
 	for {
 		select {
@@ -250,27 +474,12 @@ Loop:
 			if !ok {
 				break Loop
 			}
-			if !self.open {
-				if self.sender, err = self.dialer.Dial(); err != nil {
-					log.Errorf("No.%d sender connect to email serve failed because that %s.", self.number, err.Error())
-					msg.result <- false
-					continue Loop
-				}
-				self.open = true
-				if err := gomail.Send(self.sender, msg.message); err != nil {
-					log.Errorf("No.%d sender send email failed because that %s.", self.number, err.Error())
-					self.open = false
-					msg.result <- false
-					continue Loop
-				}
-				log.Debugf("No.%d sender send email successfully.", self.number)
-				msg.result <- true
-			}
+			self.deliver(msg)
 		case <-self.stopC:
 			break Loop
 		case <-time.After(30 * time.Second):
 			if self.open {
-				if err = self.sender.Close(); err != nil {
+				if err := self.sender.Close(); err != nil {
 					log.Errorf("No.%d sender has be idle for 30 seconds and closed failed because that %s.", self.number, err.Error())
 					if self.closeFailedTimes > 2 {
 						log.Infof("No.%d sender has close failed 2 times so set open as false", self.number)
@@ -286,6 +495,134 @@ Loop:
 			}
 		}
 	}
+	if self.open {
+		self.sender.Close()
+		self.open = false
+	}
+}
+
+// deliver always writes exactly one result to msg.result (deferred, so
+// every code path - including ones added later - reports back instead of
+// leaving send() to block until its timeout). It connects (refreshing
+// OAuth2 auth first if configured), sends, and on a transient SMTP 4xx or
+// network error retries with exponential backoff up to maxSendAttempts;
+// a permanent 5xx is reported immediately and handed to the dead-letter
+// callback instead of being retried.
+func (self *sSender) deliver(msg *sSendUnit) {
+	var result error
+	defer func() { msg.result <- result }()
+
+	for attempt := 1; attempt <= maxSendAttempts; attempt++ {
+		var err error
+		if self.man.dsn {
+			// The DSN path dials its own one-off connection (net/smtp has
+			// no way to request NOTIFY/ENVID through gomail's pooled
+			// sender), so it doesn't touch self.sender at all; it still
+			// needs a fresh OAuth2 token refreshed onto self.dialer.Auth
+			// though, same as connect() does for the pooled path.
+			if err = self.refreshOAuth2Auth(); err != nil {
+				log.Errorf("No.%d sender refresh oauth2 token failed because that %s.", self.number, err.Error())
+			} else {
+				var envelopeID string
+				if envelopeID, err = sendWithDSN(self.dialer, self.man.startTLSPolicy, msg.message); err != nil {
+					err = &errEnvelopeID{envelopeID: envelopeID, err: err}
+				} else {
+					log.Debugf("No.%d sender requested DSN with envelope-id %s.", self.number, envelopeID)
+				}
+			}
+		} else {
+			if err = self.connect(); err != nil {
+				log.Errorf("No.%d sender connect attempt %d failed because that %s.", self.number, attempt, err.Error())
+			} else if err = gomail.Send(self.sender, msg.message); err != nil {
+				if closeErr := self.sender.Close(); closeErr != nil {
+					log.Errorf("No.%d sender failed to close stale connection after send error: %s", self.number, closeErr.Error())
+				}
+				self.open = false
+			}
+		}
+
+		if err == nil {
+			log.Debugf("No.%d sender send email successfully.", self.number)
+			result = nil
+			return
+		}
+
+		result = err
+		if !isTransientErr(err) {
+			log.Errorf("No.%d sender send email permanently failed because that %s.", self.number, err.Error())
+			if self.man.deadLetter != nil {
+				self.man.deadLetter(msg.message, err)
+			}
+			return
+		}
+		log.Errorf("No.%d sender send email attempt %d failed because that %s.", self.number, attempt, err.Error())
+		self.backoffSleep(attempt)
+	}
+}
+
+// refreshOAuth2Auth is a no-op unless OAuth2 is configured, in which case
+// it refreshes the token and installs it as self.dialer.Auth.
+func (self *sSender) refreshOAuth2Auth() error {
+	if self.man.oauth2 == nil {
+		return nil
+	}
+	auth, err := newOAuth2Auth(context.Background(), SConnectInfo{
+		Username:   self.man.authUsername,
+		AuthMethod: self.man.authMethod,
+		OAuth2:     self.man.oauth2,
+	})
+	if err != nil {
+		return errors.Wrap(err, "refresh oauth2 token")
+	}
+	self.dialer.Auth = auth
+	return nil
+}
+
+// connect is a no-op when a connection is already open.
+func (self *sSender) connect() error {
+	if self.open {
+		return nil
+	}
+	if err := self.refreshOAuth2Auth(); err != nil {
+		return err
+	}
+	var sender gomail.SendCloser
+	var err error
+	if self.man.startTLSPolicy == StartTLSNone {
+		sender, err = dialNoStartTLS(self.dialer)
+	} else {
+		sender, err = self.dialer.Dial()
+	}
+	if err != nil {
+		return err
+	}
+	self.sender = sender
+	self.open = true
+	return nil
+}
+
+// backoffSleep waits out an exponential backoff (capped at 30s) between
+// redial attempts, waking early if the sender is asked to stop.
+func (self *sSender) backoffSleep(attempt int) {
+	d := time.Duration(1<<uint(attempt)) * time.Second
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	select {
+	case <-time.After(d):
+	case <-self.stopC:
+	}
+}
+
+// isTransientErr reports whether err looks like a transient SMTP 4xx or
+// network-level failure worth retrying, as opposed to a permanent 5xx
+// rejection.
+func isTransientErr(err error) bool {
+	var protoErr *textproto.Error
+	if stderrors.As(err, &protoErr) {
+		return protoErr.Code/100 == 4
+	}
+	return true
 }
 
 func (self *sSender) stop() {
@@ -298,5 +635,5 @@ func (self *sSender) stop() {
 
 type sSendUnit struct {
 	message *gomail.Message
-	result  chan<- bool
+	result  chan<- error
 }
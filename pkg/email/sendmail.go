@@ -0,0 +1,88 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/notify-plugins/pkg/common"
+)
+
+// SENDMAIL_PATH is a per-channel config key naming the local MTA binary
+// (and its arguments) to pipe RFC 5322 messages into.
+const SENDMAIL_PATH = "SENDMAIL_PATH"
+
+const defaultSendmailPath = "/usr/sbin/sendmail -t -i"
+
+type sSendmailTransport struct {
+	configCache *common.SConfigCache
+}
+
+func newSendmailTransport(configCache *common.SConfigCache) Transport {
+	return &sSendmailTransport{configCache: configCache}
+}
+
+func (self *sSendmailTransport) Send(ctx context.Context, msg *gomail.Message) error {
+	path, _ := self.configCache.Get(SENDMAIL_PATH)
+	if path == "" {
+		path = defaultSendmailPath
+	}
+	fields := strings.Fields(path)
+	if len(fields) == 0 {
+		return errors.Error("empty SENDMAIL_PATH")
+	}
+
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	var stdin bytes.Buffer
+	if _, err := msg.WriteTo(&stdin); err != nil {
+		return errors.Wrap(err, "render message")
+	}
+	cmd.Stdin = &stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "sendmail: "+strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Validate checks that the configured binary (its first field, same as
+// Send resolves) actually exists and is executable.
+func (self *sSendmailTransport) Validate(ctx context.Context) error {
+	path, _ := self.configCache.Get(SENDMAIL_PATH)
+	if path == "" {
+		path = defaultSendmailPath
+	}
+	fields := strings.Fields(path)
+	if len(fields) == 0 {
+		return errors.Error("empty SENDMAIL_PATH")
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return errors.Wrap(err, "sendmail binary not found")
+	}
+	return nil
+}
+
+func (self *sSendmailTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+)
+
+const (
+	TLS_INSECURE    = "TLS_INSECURE"
+	TLS_SERVER_NAME = "TLS_SERVER_NAME"
+	TLS_CA_CERT     = "TLS_CA_CERT"
+	TLS_CLIENT_CERT = "TLS_CLIENT_CERT"
+	TLS_CLIENT_KEY  = "TLS_CLIENT_KEY"
+
+	STARTTLS_POLICY = "STARTTLS_POLICY"
+)
+
+const (
+	StartTLSOpportunistic = "opportunistic"
+	StartTLSRequired      = "required"
+	StartTLSNone          = "none"
+)
+
+var (
+	ErrSTARTTLSRequired = errors.Error("STARTTLS required but not supported by server")
+	ErrTLSCertVerify    = errors.Error("cert verification failed")
+	ErrTLSHostMismatch  = errors.Error("hostname mismatch")
+)
+
+// STLSConfig holds the TLS-related knobs for a connection, decoded from the
+// TLS_*/STARTTLS_POLICY config keys.
+type STLSConfig struct {
+	Insecure   bool
+	ServerName string
+	CACert     string
+	ClientCert string
+	ClientKey  string
+
+	// StartTLSPolicy is one of StartTLSOpportunistic (default),
+	// StartTLSRequired or StartTLSNone.
+	StartTLSPolicy string
+}
+
+// buildTLSConfig turns an STLSConfig into a *tls.Config, defaulting
+// ServerName to hostname and loading any configured CA/client cert.
+func buildTLSConfig(hostname string, cfg STLSConfig) (*tls.Config, error) {
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = hostname
+	}
+	tlsConf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.Insecure,
+	}
+	if cfg.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+			return nil, errors.Wrap(ErrTLSCertVerify, "invalid TLS_CA_CERT PEM")
+		}
+		tlsConf.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.ClientCert), []byte(cfg.ClientKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "load TLS_CLIENT_CERT/TLS_CLIENT_KEY")
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// probeStartTLS dials hostname:port in the clear and checks whether the
+// server advertises STARTTLS, without actually upgrading the connection.
+// It's used to enforce STARTTLS_POLICY=required before handing the real
+// connection to gomail, which otherwise silently falls back to cleartext.
+func probeStartTLS(hostname string, port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", hostname, port), 10*time.Second)
+	if err != nil {
+		return errors.Wrap(err, "dial")
+	}
+	defer conn.Close()
+
+	client, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		return errors.Wrap(err, "smtp handshake")
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		return ErrSTARTTLSRequired
+	}
+	return nil
+}
+
+// dialNoStartTLS dials dialer's host:port and authenticates, like
+// gomail.Dialer.Dial(), but never issues STARTTLS even when the server
+// advertises it. It exists because gomail.Dial() opportunistically
+// upgrades to STARTTLS whenever the server offers it, with no knob to
+// suppress that; STARTTLS_POLICY=none routes through here instead so the
+// session actually stays in the clear, e.g. against a local relay that
+// mishandles STARTTLS.
+func dialNoStartTLS(dialer *gomail.Dialer) (gomail.SendCloser, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", dialer.Host, dialer.Port), 10*time.Second)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	client, err := smtp.NewClient(conn, dialer.Host)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "smtp handshake")
+	}
+	// dialer.Auth is only set for OAuth2; build username/password auth
+	// here the same way sendWithDSN does.
+	auth := dialer.Auth
+	if auth == nil && dialer.Username != "" {
+		if ok, auths := client.Extension("AUTH"); ok {
+			if strings.Contains(auths, "CRAM-MD5") {
+				auth = smtp.CRAMMD5Auth(dialer.Username, dialer.Password)
+			} else {
+				auth = smtp.PlainAuth("", dialer.Username, dialer.Password, dialer.Host)
+			}
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(auth); err != nil {
+				client.Close()
+				return nil, errors.Wrap(err, "auth")
+			}
+		}
+	}
+	return &plainSMTPSender{client: client}, nil
+}
+
+// plainSMTPSender is the gomail.SendCloser returned by dialNoStartTLS.
+type plainSMTPSender struct {
+	client *smtp.Client
+}
+
+func (self *plainSMTPSender) Send(from string, to []string, msg io.WriterTo) error {
+	if err := self.client.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := self.client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := self.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (self *plainSMTPSender) Close() error {
+	return self.client.Quit()
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package email
+
+import (
+	"context"
+
+	"gopkg.in/gomail.v2"
+
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/notify-plugins/pkg/common"
+)
+
+// TRANSPORT picks which backend actually hands a built message off to the
+// outside world; it's a per-channel config key, same family as HOSTNAME.
+const TRANSPORT = "TRANSPORT"
+
+const (
+	TransportSMTP     = "smtp"
+	TransportSendmail = "sendmail"
+	TransportHTTP     = "http"
+)
+
+// Transport abstracts delivery of an already-built RFC 5322 message so
+// deployments without outbound SMTP access (no egress on 25/465/587) can
+// still relay mail through a local MTA binary or an HTTP(S) relay,
+// without SEmailSender's public common.ISender surface changing.
+//
+// The default "smtp" backend is SEmailSender itself (dialer + worker pool
+// + retries/backoff/DSN all stay as-is); Transport only covers the two
+// new backends, selected in initSender and invoked directly from send(),
+// bypassing the SMTP worker pool entirely.
+type Transport interface {
+	Send(ctx context.Context, msg *gomail.Message) error
+	// Validate reports whether the backend is actually usable (MTA binary
+	// present, relay reachable, ...), for ValidateConfig to call instead
+	// of inferring validity from newTransport merely succeeding.
+	Validate(ctx context.Context) error
+	Close() error
+}
+
+// newTransport builds the Transport named by kind, or (nil, nil) for
+// "smtp"/"" so callers keep using the built-in worker pool.
+func newTransport(kind string, configCache *common.SConfigCache) (Transport, error) {
+	switch kind {
+	case "", TransportSMTP:
+		return nil, nil
+	case TransportSendmail:
+		return newSendmailTransport(configCache), nil
+	case TransportHTTP:
+		return newHTTPTransport(configCache)
+	default:
+		return nil, errors.Error("unknown TRANSPORT " + kind)
+	}
+}